@@ -0,0 +1,247 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultCacheSize is used when an upstream source doesn't configure
+// its own cache size.
+const defaultCacheSize = 100
+
+// cacheShardCount is the number of shards a lookupCache is split into,
+// to reduce lock contention across keys of high cardinality. Each
+// shard gets its own lock, LRU list, and singleflight group.
+const cacheShardCount = 16
+
+// lookupCache is a size-bounded, sharded LRU cache for the results of
+// upstream lookups (SRV, A/AAAA, etc). It coalesces concurrent misses
+// for the same key into a single call to the fill function, and reports
+// hit/miss/eviction/duration metrics labeled by source name. Unlike a
+// plain memoizing map, a failed lookup can be cached too (the fill
+// function reports its own TTL for both outcomes), so a source of
+// negative answers doesn't force every caller back through a slow
+// lookup.
+type lookupCache[V any] struct {
+	source string // metric label, e.g. "srv" or "a"
+	shards [cacheShardCount]*lookupCacheShard[V]
+
+	// onRemove, if set, is called with the value of any entry that's
+	// overwritten or evicted, so callers can clean up side tables
+	// keyed off that value (e.g. SRV weight info keyed by *Upstream).
+	onRemove func(V)
+
+	// resizeOnce ensures only the first call to resize with a positive
+	// size takes effect.
+	resizeOnce sync.Once
+}
+
+type lookupCacheShard[V any] struct {
+	source   string
+	onRemove func(V)
+	mu       sync.Mutex
+	maxLen   int
+	ll       *list.List // front = most recently used
+	items    map[string]*list.Element
+	filling  singleflight.Group
+}
+
+type lookupCacheItem[V any] struct {
+	key       string
+	value     V
+	err       error
+	freshness time.Time
+	ttl       time.Duration
+}
+
+func (it *lookupCacheItem[V]) isFresh() bool {
+	return !it.freshness.IsZero() && time.Since(it.freshness) < it.ttl
+}
+
+func newLookupCache[V any](source string, maxEntries int) *lookupCache[V] {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheSize
+	}
+	perShard := maxEntries/cacheShardCount + 1
+
+	lc := &lookupCache[V]{source: source}
+	for i := range lc.shards {
+		lc.shards[i] = &lookupCacheShard[V]{
+			source: source,
+			maxLen: perShard,
+			ll:     list.New(),
+			items:  make(map[string]*list.Element),
+		}
+	}
+	return lc
+}
+
+// setOnRemove registers a callback invoked with the value of any entry
+// that is overwritten or evicted from the cache. Must be called before
+// the cache is used concurrently.
+func (lc *lookupCache[V]) setOnRemove(fn func(V)) {
+	lc.onRemove = fn
+	for _, shard := range lc.shards {
+		shard.onRemove = fn
+	}
+}
+
+// resize adjusts the per-shard capacity. It's safe to call concurrently,
+// but since all instances of a given upstream source share one cache,
+// only the first call with a positive maxEntries (that is, the first
+// Provision with a cache_size set) has an effect: calls with a
+// non-positive size are ignored and later calls are no-ops, so that one
+// upstream block's cache_size can't silently
+// shrink or grow the cache out from under every other block sharing it.
+func (lc *lookupCache[V]) resize(maxEntries int) {
+	if maxEntries <= 0 {
+		return
+	}
+	lc.resizeOnce.Do(func() {
+		perShard := maxEntries/cacheShardCount + 1
+		for _, shard := range lc.shards {
+			shard.mu.Lock()
+			shard.maxLen = perShard
+			shard.mu.Unlock()
+		}
+	})
+}
+
+func (lc *lookupCache[V]) shardFor(key string) *lookupCacheShard[V] {
+	return lc.shards[fnv32a(key)%cacheShardCount]
+}
+
+// fnv32a is a tiny, dependency-free string hash used only to pick a
+// shard; it does not need to be cryptographically strong.
+func fnv32a(s string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= prime32
+	}
+	return h
+}
+
+// GetOrCompute returns the cached value, remaining TTL, and error for
+// key if an entry for it is still fresh; otherwise it calls fill to
+// produce a new value, TTL, and error, caches all three (a fill error is
+// cached too, for whatever TTL fill reports, typically a shorter
+// negative-caching TTL), and returns them. Concurrent calls for the same
+// key within the same shard coalesce into a single call to fill.
+func (lc *lookupCache[V]) GetOrCompute(key string, fill func() (V, time.Duration, error)) (V, time.Duration, error) {
+	shard := lc.shardFor(key)
+
+	if item, ok := shard.fresh(key); ok {
+		cacheHitsTotal.WithLabelValues(lc.source).Inc()
+		return item.value, time.Until(item.freshness.Add(item.ttl)), item.err
+	}
+
+	cacheMissesTotal.WithLabelValues(lc.source).Inc()
+
+	start := time.Now()
+	shard.filling.Do(key, func() (any, error) {
+		value, ttl, err := fill()
+		shard.set(key, value, err, ttl)
+		return nil, nil
+	})
+	cacheLookupDuration.WithLabelValues(lc.source).Observe(time.Since(start).Seconds())
+
+	item := shard.get(key)
+	return item.value, time.Until(item.freshness.Add(item.ttl)), item.err
+}
+
+// fresh returns the cached item for key, moving it to the front of the
+// LRU list, only if it's still within its TTL.
+func (s *lookupCacheShard[V]) fresh(key string) (*lookupCacheItem[V], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*lookupCacheItem[V])
+	if !item.isFresh() {
+		return nil, false
+	}
+	s.ll.MoveToFront(el)
+	return item, true
+}
+
+// get returns the cached item for key regardless of freshness. It's used
+// right after set, to read back exactly what was just stored (including
+// a fill error and its TTL) without duplicating that logic here.
+func (s *lookupCacheShard[V]) get(key string) *lookupCacheItem[V] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	return el.Value.(*lookupCacheItem[V])
+}
+
+func (s *lookupCacheShard[V]) set(key string, value V, err error, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		item := el.Value.(*lookupCacheItem[V])
+		old := item.value
+		item.value, item.err, item.freshness, item.ttl = value, err, time.Now(), ttl
+		s.ll.MoveToFront(el)
+		if s.onRemove != nil {
+			s.onRemove(old)
+		}
+		return
+	}
+
+	el := s.ll.PushFront(&lookupCacheItem[V]{key: key, value: value, err: err, freshness: time.Now(), ttl: ttl})
+	s.items[key] = el
+
+	for s.ll.Len() > s.maxLen {
+		oldest := s.ll.Back()
+		if oldest == nil {
+			break
+		}
+		s.ll.Remove(oldest)
+		oldItem := oldest.Value.(*lookupCacheItem[V])
+		delete(s.items, oldItem.key)
+		cacheEvictionsTotal.WithLabelValues(s.source).Inc()
+		if s.onRemove != nil {
+			s.onRemove(oldItem.value)
+		}
+	}
+}
+
+var (
+	cacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstreams_cache_hits_total",
+		Help: "Count of cache hits while resolving dynamic upstreams via DNS.",
+	}, []string{"source"})
+
+	cacheMissesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstreams_cache_misses_total",
+		Help: "Count of cache misses while resolving dynamic upstreams via DNS.",
+	}, []string{"source"})
+
+	cacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstreams_cache_evictions_total",
+		Help: "Count of entries evicted from the dynamic upstreams DNS cache to make room for new ones.",
+	}, []string{"source"})
+
+	cacheLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dns_upstreams_cache_lookup_duration_seconds",
+		Help: "Time spent performing a DNS lookup on a dynamic upstreams cache miss.",
+	}, []string{"source"})
+)
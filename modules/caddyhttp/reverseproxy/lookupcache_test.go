@@ -0,0 +1,127 @@
+package reverseproxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupCacheHitsAndMisses(t *testing.T) {
+	lc := newLookupCache[int]("test-hits", 10)
+
+	var calls int32
+	fill := func() (int, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return 42, time.Hour, nil
+	}
+
+	v, _, err := lc.GetOrCompute("a", fill)
+	if err != nil || v != 42 {
+		t.Fatalf("unexpected result: %v, %v", v, err)
+	}
+	v, _, err = lc.GetOrCompute("a", fill)
+	if err != nil || v != 42 {
+		t.Fatalf("unexpected result on second call: %v, %v", v, err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected fill to be called once (cache hit on second call), got %d", got)
+	}
+}
+
+func TestLookupCacheEvictsOldest(t *testing.T) {
+	// with cacheShardCount shards, requesting maxEntries=cacheShardCount
+	// yields cacheShardCount/cacheShardCount+1 = 2 slots per shard, so a
+	// third entry in one shard must evict the least recently used one.
+	lc := newLookupCache[int]("test-evict", cacheShardCount) // 2 entries per shard after rounding
+
+	var removed []int
+	var mu sync.Mutex
+	lc.setOnRemove(func(v int) {
+		mu.Lock()
+		removed = append(removed, v)
+		mu.Unlock()
+	})
+
+	shard := lc.shards[0]
+
+	// insert directly into shard 0 via its key hash isn't guaranteed, so
+	// instead fill the same shard repeatedly using its set method directly.
+	shard.set("k1", 1, nil, time.Hour)
+	shard.set("k2", 2, nil, time.Hour)
+	shard.set("k3", 3, nil, time.Hour)
+
+	if shard.ll.Len() > shard.maxLen {
+		t.Errorf("shard exceeded its max length: %d > %d", shard.ll.Len(), shard.maxLen)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(removed) != 1 || removed[0] != 1 {
+		t.Errorf("expected onRemove to fire once, for the oldest entry (1), got %v", removed)
+	}
+}
+
+func TestLookupCacheCachesFailureForItsOwnTTL(t *testing.T) {
+	lc := newLookupCache[int]("test-negative", 10)
+	wantErr := errors.New("boom")
+
+	var calls int32
+	fill := func() (int, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return 0, time.Minute, wantErr
+	}
+
+	_, ttl, err := lc.GetOrCompute("a", fill)
+	if err == nil || err.Error() != wantErr.Error() {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+	if ttl <= 0 {
+		t.Errorf("ttl = %v, want > 0 so the failure is actually cached", ttl)
+	}
+
+	_, _, err = lc.GetOrCompute("a", fill)
+	if err == nil || err.Error() != wantErr.Error() {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected fill to be called once (failure served from cache on second call), got %d", got)
+	}
+}
+
+func TestLookupCacheCoalescesConcurrentMisses(t *testing.T) {
+	lc := newLookupCache[int]("test-coalesce", 10)
+
+	var calls int32
+	release := make(chan struct{})
+	fill := func() (int, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 7, time.Hour, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, _ := lc.GetOrCompute("shared-key", fill)
+			results[i] = v
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond) // let all goroutines queue up behind the in-flight fill
+	close(release)
+	wg.Wait()
+
+	for i, v := range results {
+		if v != 7 {
+			t.Errorf("result %d: expected 7, got %d", i, v)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected concurrent misses to coalesce into 1 fill call, got %d", got)
+	}
+}
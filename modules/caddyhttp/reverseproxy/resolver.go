@@ -0,0 +1,317 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// Resolver configures the DNS resolver used by upstream sources that
+// need to perform DNS lookups, namely SRVUpstreams and AUpstreams. By
+// default those sources use the operating system's resolver; setting
+// this lets an operator point lookups at a specific DNS server (such as
+// an internal CoreDNS) and/or use an encrypted transport.
+type Resolver struct {
+	// The addresses of the DNS servers to query, e.g. "10.0.0.53:53"
+	// or, for DoH, a full URL like "https://dns.example.com/dns-query".
+	// Tried in order until one answers. Default: the system resolver's
+	// configured servers.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// The transport protocol to use: "udp" (default), "tcp",
+	// "tls" (DNS-over-TLS), or "https" (DNS-over-HTTPS).
+	Protocol string `json:"protocol,omitempty"`
+
+	// When Protocol is "https" and an address is a hostname (not an
+	// IP), Bootstrap gives the plain-DNS server(s) (e.g. "1.1.1.1:53")
+	// used to resolve that hostname itself, instead of the system
+	// resolver, to avoid a bootstrapping deadlock when this Resolver is
+	// also the system's only resolver.
+	Bootstrap []string `json:"bootstrap,omitempty"`
+
+	// Timeout for each individual query. Default: 5s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How long to cache a successful answer when its own TTL cannot be
+	// determined. Normally the answer's record TTL is used instead.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// How long to cache a failed (NXDOMAIN/SERVFAIL) answer. Caching
+	// negative answers separately, and for a shorter time than
+	// positive ones, means a transient DNS failure doesn't force every
+	// subsequent request through this upstream source to also block on
+	// a DNS round trip. Default: 5s
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"`
+
+	client     *dns.Client
+	httpClient *http.Client
+
+	// srvCache and ipCache hold this Resolver's own lookups, bounded,
+	// sharded, and singleflight-coalesced exactly like the package-level
+	// srvCache/aCache/resolveIPCache used when no custom Resolver is
+	// configured. A failed lookup is cached too, for NegativeCacheTTL,
+	// so a transient failure doesn't force every subsequent call back
+	// through a DNS round trip.
+	srvCache *lookupCache[[]*dns.SRV]
+	ipCache  *lookupCache[[]net.IP]
+}
+
+// Provision sets up the resolver's DNS client and defaults.
+func (re *Resolver) Provision(_ caddy.Context) error {
+	if re.Timeout == 0 {
+		re.Timeout = caddy.Duration(5 * time.Second)
+	}
+	if re.NegativeCacheTTL == 0 {
+		re.NegativeCacheTTL = caddy.Duration(5 * time.Second)
+	}
+
+	switch re.Protocol {
+	case "", "udp":
+		re.client = &dns.Client{Net: "udp", Timeout: time.Duration(re.Timeout)}
+	case "tcp":
+		re.client = &dns.Client{Net: "tcp", Timeout: time.Duration(re.Timeout)}
+	case "tls":
+		re.client = &dns.Client{Net: "tcp-tls", Timeout: time.Duration(re.Timeout)}
+	case "https":
+		re.client = nil // DoH is exchanged over net/http instead, see exchangeDoH
+		re.httpClient = &http.Client{Timeout: time.Duration(re.Timeout)}
+		if len(re.Bootstrap) > 0 {
+			re.httpClient.Transport = &http.Transport{DialContext: re.bootstrapDialContext}
+		}
+	default:
+		return fmt.Errorf("unrecognized resolver protocol '%s'", re.Protocol)
+	}
+
+	re.srvCache = newLookupCache[[]*dns.SRV]("resolver-srv", defaultCacheSize)
+	re.ipCache = newLookupCache[[]net.IP]("resolver-a", defaultCacheSize)
+
+	return nil
+}
+
+// bootstrapDialContext dials the DoH server for re.httpClient. If the
+// host portion of addr is a hostname and Bootstrap servers are
+// configured, it resolves that hostname through them directly instead of
+// the system resolver, avoiding the deadlock that would occur if this
+// Resolver is also configured as the system's only resolver. The TLS
+// handshake still verifies against the original hostname, since only the
+// dial target (not the URL net/http uses for SNI) is changed.
+func (re *Resolver) bootstrapDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		ip, err := re.bootstrapLookup(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap lookup of DoH host %q: %v", host, err)
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// bootstrapLookup resolves host to an IP address using only the
+// Bootstrap servers, via plain DNS, so it can't recurse back into the
+// DoH server it exists to bootstrap.
+func (re *Resolver) bootstrapLookup(ctx context.Context, host string) (net.IP, error) {
+	client := &dns.Client{Net: "udp", Timeout: time.Duration(re.Timeout)}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	var lastErr error
+	for _, server := range re.Bootstrap {
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ans := range resp.Answer {
+			if a, ok := ans.(*dns.A); ok {
+				return a.A, nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no A record found for %q among bootstrap servers", host)
+}
+
+// LookupSRV resolves the given SRV domain, returning the records found
+// and the TTL that should be used to cache them (the minimum TTL across
+// the answer set).
+func (re *Resolver) LookupSRV(ctx context.Context, domain string) ([]*dns.SRV, time.Duration, error) {
+	return re.srvCache.GetOrCompute(domain, func() ([]*dns.SRV, time.Duration, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(domain), dns.TypeSRV)
+
+		resp, err := re.exchange(ctx, msg)
+		if err != nil {
+			return nil, time.Duration(re.NegativeCacheTTL), err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			rcodeErr := fmt.Errorf("dns: %s", dns.RcodeToString[resp.Rcode])
+			return nil, time.Duration(re.NegativeCacheTTL), rcodeErr
+		}
+
+		var records []*dns.SRV
+		var ttls []uint32
+		for _, ans := range resp.Answer {
+			srv, ok := ans.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			records = append(records, srv)
+			ttls = append(ttls, srv.Hdr.Ttl)
+		}
+		minTTL, seen := minRRTTL(ttls)
+		ttl := time.Duration(minTTL) * time.Second
+		if !seen {
+			ttl = time.Duration(re.CacheTTL)
+		}
+		return records, ttl, nil
+	})
+}
+
+// LookupIPs resolves the given name to its A/AAAA addresses, returning
+// the TTL that should be used to cache them.
+func (re *Resolver) LookupIPs(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	return re.ipCache.GetOrCompute(name, func() ([]net.IP, time.Duration, error) {
+		var ips []net.IP
+		var ttls []uint32
+		var lookupErr error
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(name), qtype)
+
+			resp, err := re.exchange(ctx, msg)
+			if err != nil {
+				lookupErr = err
+				continue
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				lookupErr = fmt.Errorf("dns: %s", dns.RcodeToString[resp.Rcode])
+				continue
+			}
+			for _, ans := range resp.Answer {
+				var ttl uint32
+				var ip net.IP
+				switch rr := ans.(type) {
+				case *dns.A:
+					ip, ttl = rr.A, rr.Hdr.Ttl
+				case *dns.AAAA:
+					ip, ttl = rr.AAAA, rr.Hdr.Ttl
+				default:
+					continue
+				}
+				ips = append(ips, ip)
+				ttls = append(ttls, ttl)
+			}
+		}
+
+		if len(ips) == 0 && lookupErr != nil {
+			return nil, time.Duration(re.NegativeCacheTTL), lookupErr
+		}
+		minTTL, seen := minRRTTL(ttls)
+		positiveTTL := time.Duration(minTTL) * time.Second
+		if !seen {
+			positiveTTL = time.Duration(re.CacheTTL)
+		}
+		return ips, positiveTTL, nil
+	})
+}
+
+// minRRTTL returns the lowest TTL among ttls and whether any were given
+// at all. The two are tracked separately so that a record reporting an
+// explicit TTL of 0 (a legitimate "don't cache this" answer) isn't
+// confused with "no records seen, fall back to CacheTTL" the way a bare
+// zero-valued uint32 would be.
+func minRRTTL(ttls []uint32) (min uint32, seen bool) {
+	for _, ttl := range ttls {
+		if !seen || ttl < min {
+			min = ttl
+			seen = true
+		}
+	}
+	return min, seen
+}
+
+// exchange sends msg to the configured server(s), trying each in order
+// until one answers, using the configured protocol (including DoH).
+func (re *Resolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	servers := re.Addresses
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("no resolver addresses configured and failed to read system config: %v", err)
+		}
+		for _, s := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		var resp *dns.Msg
+		var err error
+		if re.Protocol == "https" {
+			resp, err = re.exchangeDoH(ctx, server, msg)
+		} else {
+			resp, _, err = re.client.ExchangeContext(ctx, msg, server)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("all resolver addresses failed, last error: %v", lastErr)
+}
+
+// exchangeDoH performs a DNS-over-HTTPS query per RFC 8484.
+func (re *Resolver) exchangeDoH(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := re.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s returned status %s", server, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+var _ caddy.Provisioner = (*Resolver)(nil)
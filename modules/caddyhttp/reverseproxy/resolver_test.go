@@ -0,0 +1,110 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+func TestResolverLookupIPsLiteralIP(t *testing.T) {
+	re := &Resolver{ipCache: newLookupCache[[]net.IP]("test-resolver-a", defaultCacheSize)}
+
+	ips, ttl, err := re.LookupIPs(context.Background(), "10.0.0.5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ttl != 0 {
+		t.Errorf("ttl = %v, want 0 for a literal IP (nothing to cache)", ttl)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("ips = %v, want [10.0.0.5]", ips)
+	}
+}
+
+func TestResolverLookupIPsServesFreshCacheWithoutExchange(t *testing.T) {
+	re := &Resolver{ipCache: newLookupCache[[]net.IP]("test-resolver-a", defaultCacheSize)}
+	want := []net.IP{net.ParseIP("10.0.0.9")}
+	re.ipCache.GetOrCompute("example.com", func() ([]net.IP, time.Duration, error) {
+		return want, time.Minute, nil
+	})
+
+	// re.client is nil, so if LookupIPs tried to actually exchange a
+	// query instead of serving the fresh cache entry, this would panic.
+	ips, ttl, err := re.LookupIPs(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ttl <= 0 {
+		t.Errorf("ttl = %v, want > 0 for an entry that hasn't expired", ttl)
+	}
+	if len(ips) != 1 || !ips[0].Equal(want[0]) {
+		t.Errorf("ips = %v, want %v", ips, want)
+	}
+}
+
+func TestResolverLookupSRVServesCachedNegativeAnswerWithoutExchange(t *testing.T) {
+	re := &Resolver{srvCache: newLookupCache[[]*dns.SRV]("test-resolver-srv", defaultCacheSize)}
+	wantErr := errors.New("dns: NXDOMAIN")
+	re.srvCache.GetOrCompute("_http._tcp.example.com", func() ([]*dns.SRV, time.Duration, error) {
+		return nil, time.Second, wantErr
+	})
+
+	// re.client is nil, so if LookupSRV tried to actually exchange a
+	// query instead of serving the cached negative answer, this would panic.
+	_, ttl, err := re.LookupSRV(context.Background(), "_http._tcp.example.com")
+	if err == nil || err.Error() != wantErr.Error() {
+		t.Errorf("err = %v, want %v", err, wantErr)
+	}
+	if ttl <= 0 {
+		t.Errorf("ttl = %v, want > 0 for an entry that hasn't expired", ttl)
+	}
+}
+
+func TestMinRRTTL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ttls     []uint32
+		wantMin  uint32
+		wantSeen bool
+	}{
+		{"no records", nil, 0, false},
+		{"single record, explicit zero TTL", []uint32{0}, 0, true},
+		{"lowest wins regardless of position", []uint32{300, 60, 120}, 60, true},
+		{"a zero among non-zero TTLs still wins", []uint32{300, 0, 120}, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			min, seen := minRRTTL(tc.ttls)
+			if min != tc.wantMin || seen != tc.wantSeen {
+				t.Errorf("minRRTTL(%v) = (%d, %v), want (%d, %v)", tc.ttls, min, seen, tc.wantMin, tc.wantSeen)
+			}
+		})
+	}
+}
+
+func TestResolverProvisionDefaults(t *testing.T) {
+	re := &Resolver{}
+	if err := re.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if re.Timeout != caddy.Duration(5*time.Second) {
+		t.Errorf("Timeout = %v, want 5s default", re.Timeout)
+	}
+	if re.NegativeCacheTTL != caddy.Duration(5*time.Second) {
+		t.Errorf("NegativeCacheTTL = %v, want 5s default", re.NegativeCacheTTL)
+	}
+}
+
+func TestResolverProvisionHTTPSWithBootstrapSetsDialer(t *testing.T) {
+	re := &Resolver{Protocol: "https", Bootstrap: []string{"1.1.1.1:53"}}
+	if err := re.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if re.httpClient == nil || re.httpClient.Transport == nil {
+		t.Fatal("expected a custom transport to be configured when Bootstrap is set")
+	}
+}
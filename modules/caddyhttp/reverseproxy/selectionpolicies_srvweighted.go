@@ -0,0 +1,110 @@
+package reverseproxy
+
+import (
+	"math/rand"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(SRVWeightedSelection{})
+}
+
+// SRVWeightedSelection is a selection policy that honors RFC 2782
+// priority and weight, as reported by an upstream source implementing
+// WeightedUpstreamSource (namely SRVUpstreams). It considers only the
+// upstreams in the lowest-priority tier that has at least one available
+// upstream, then picks among that tier proportionally to weight. Per
+// RFC 2782 §3, a weight of 0 is a sentinel meaning "no preference": if
+// every upstream in the chosen tier has weight 0, selection within the
+// tier is uniform.
+//
+// Upstreams not reported with any priority/weight information (for
+// example, because they did not come from a WeightedUpstreamSource) are
+// all treated as a single tier with priority 0 and weight 0.
+type SRVWeightedSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (SRVWeightedSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.srv_weighted",
+		New: func() caddy.Module { return new(SRVWeightedSelection) },
+	}
+}
+
+// Select returns an available upstream from the pool, honoring SRV
+// priority and weight when that information is available.
+func (SRVWeightedSelection) Select(pool UpstreamPool, r *http.Request, _ http.ResponseWriter) *Upstream {
+	priorities, weights := srvWeightsFor(pool)
+
+	available := make([]bool, len(pool))
+	for i, upstream := range pool {
+		available[i] = upstream.Available()
+	}
+
+	idx := pickSRVWeighted(priorities, weights, available)
+	if idx < 0 {
+		return nil
+	}
+	return pool[idx]
+}
+
+// srvWeightsFor returns, for each upstream in pool, the priority and
+// weight reported for it by a WeightedUpstreamSource, defaulting to 0
+// for upstreams with no such information.
+func srvWeightsFor(pool UpstreamPool) (priorities, weights []uint16) {
+	return SRVUpstreams{}.GetSRVWeights(pool)
+}
+
+// pickSRVWeighted selects an index among the available entries whose
+// priority is lowest, proportionally to weight within that tier (with
+// an all-zero-weight tier treated as uniform, per RFC 2782 §3). It
+// returns -1 if no entry is available. The three slices must be the
+// same length.
+func pickSRVWeighted(priorities, weights []uint16, available []bool) int {
+	tiers := make(map[uint16][]int) // priority -> indices
+	lowest := ^uint16(0)
+	for i, ok := range available {
+		if !ok {
+			continue
+		}
+		p := priorities[i]
+		tiers[p] = append(tiers[p], i)
+		if p < lowest {
+			lowest = p
+		}
+	}
+
+	tier := tiers[lowest]
+	if len(tier) == 0 {
+		return -1
+	}
+	if len(tier) == 1 {
+		return tier[0]
+	}
+
+	totalWeight := 0
+	for _, idx := range tier {
+		totalWeight += int(weights[idx])
+	}
+	if totalWeight == 0 {
+		// all weights in this tier are the RFC 2782 "no preference" sentinel
+		return tier[rand.Intn(len(tier))]
+	}
+
+	r := rand.Intn(totalWeight)
+	for _, idx := range tier {
+		r -= int(weights[idx])
+		if r < 0 {
+			return idx
+		}
+	}
+	return tier[len(tier)-1] // unreachable in practice
+}
+
+// Interface guards
+var (
+	_ caddy.Module    = (*SRVWeightedSelection)(nil)
+	_ SelectionPolicy = (*SRVWeightedSelection)(nil)
+)
@@ -0,0 +1,68 @@
+package reverseproxy
+
+import "testing"
+
+func TestPickSRVWeightedTiedWeights(t *testing.T) {
+	priorities := []uint16{0, 0, 0}
+	weights := []uint16{5, 5, 5}
+	available := []bool{true, true, true}
+
+	counts := make([]int, 3)
+	for i := 0; i < 3000; i++ {
+		idx := pickSRVWeighted(priorities, weights, available)
+		counts[idx]++
+	}
+	for i, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("expected roughly even distribution for tied weights, index %d got %d/3000", i, c)
+		}
+	}
+}
+
+func TestPickSRVWeightedAllZero(t *testing.T) {
+	priorities := []uint16{0, 0, 0}
+	weights := []uint16{0, 0, 0}
+	available := []bool{true, true, true}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		idx := pickSRVWeighted(priorities, weights, available)
+		if idx < 0 || idx >= 3 {
+			t.Fatalf("got out-of-range index %d", idx)
+		}
+		seen[idx] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected all-zero weights to select uniformly among all entries, only saw %v", seen)
+	}
+}
+
+func TestPickSRVWeightedMultiPriorityFallback(t *testing.T) {
+	// lowest priority bucket (0) is entirely unhealthy; should fall back to priority 1
+	priorities := []uint16{0, 0, 1, 1}
+	weights := []uint16{10, 10, 1, 9}
+	available := []bool{false, false, true, true}
+
+	counts := map[int]int{}
+	for i := 0; i < 2000; i++ {
+		idx := pickSRVWeighted(priorities, weights, available)
+		if idx != 2 && idx != 3 {
+			t.Fatalf("expected fallback to priority-1 tier (index 2 or 3), got %d", idx)
+		}
+		counts[idx]++
+	}
+	// index 3 has 9x the weight of index 2, so it should win the large majority of the time
+	if counts[3] < counts[2] {
+		t.Errorf("expected heavier-weighted upstream to be picked more often: %v", counts)
+	}
+}
+
+func TestPickSRVWeightedNoneAvailable(t *testing.T) {
+	priorities := []uint16{0, 0}
+	weights := []uint16{1, 1}
+	available := []bool{false, false}
+
+	if idx := pickSRVWeighted(priorities, weights, available); idx != -1 {
+		t.Errorf("expected -1 when nothing is available, got %d", idx)
+	}
+}
@@ -1,9 +1,11 @@
 package reverseproxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -44,7 +46,35 @@ type SRVUpstreams struct {
 	// empty, the entire domain name to look up.
 	Name string `json:"name,omitempty"`
 
-	logger *zap.Logger
+	// If true, for each SRV target that is not already a literal IP,
+	// resolve it to its A/AAAA addresses and return one Upstream per
+	// resolved IP instead of one Upstream per SRV target. This is
+	// useful when SRV targets point at headless Kubernetes services or
+	// other DNS names that round-robin across multiple addresses,
+	// since it lets the configured selection policy see (and load
+	// balance across) each address individually. Resolved IPs are
+	// cached separately from the SRV cache, honoring Refresh as a TTL,
+	// or the record TTL when Resolver is configured.
+	ResolveIPs bool `json:"resolve_ips,omitempty"`
+
+	// The DNS resolver to use for SRV (and, if ResolveIPs is set,
+	// A/AAAA) lookups. If unset, the operating system's resolver is
+	// used. Configuring this lets lookups target a specific DNS
+	// server, optionally over an encrypted transport, and lets
+	// negative (failed) answers be cached separately from positive
+	// ones. If Refresh is left unset, the resolver's reported record
+	// TTL is used as the refresh interval instead of the 1m default.
+	Resolver *Resolver `json:"resolver,omitempty"`
+
+	// The approximate number of distinct SRV lookups to keep cached at
+	// once, shared across all uses of this module. The cache is split
+	// into 16 shards of CacheSize/16+1 entries each, so a shard can evict
+	// before the total is reached and the total can slightly exceed
+	// CacheSize. Default: 100
+	CacheSize int `json:"cache_size,omitempty"`
+
+	refreshAuto bool
+	logger      *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -66,101 +96,233 @@ func (su *SRVUpstreams) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("invalid proto '%s'", su.Proto)
 	}
 	if su.Refresh == 0 {
+		su.refreshAuto = true
 		su.Refresh = time.Minute
 	}
+	if su.Resolver != nil {
+		if err := su.Resolver.Provision(ctx); err != nil {
+			return fmt.Errorf("provisioning resolver: %v", err)
+		}
+	}
+	srvCache.resize(su.CacheSize)
 	return nil
 }
 
 func (su SRVUpstreams) GetUpstreams(r *http.Request) ([]*Upstream, error) {
-	suStr := su.String()
-
-	// first, use a cheap read-lock to return a cached result quickly
-	srvsMu.RLock()
-	cached := srvs[suStr]
-	srvsMu.RUnlock()
-	if cached.isFresh() {
-		return cached.upstreams, nil
-	}
+	upstreams, _, err := srvCache.GetOrCompute(su.String(), func() ([]*Upstream, time.Duration, error) {
+		// prepare parameters and perform the SRV lookup
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		service := repl.ReplaceAll(su.Service, "")
+		proto := repl.ReplaceAll(su.Proto, "")
+		name := repl.ReplaceAll(su.Name, "")
+
+		su.logger.Debug("refreshing SRV upstreams",
+			zap.String("service", service),
+			zap.String("proto", proto),
+			zap.String("name", name))
+
+		records, ttl, err := su.lookupSRV(r.Context(), service, proto, name)
+		if err != nil {
+			// From LookupSRV docs: "If the response contains invalid names, those records are filtered
+			// out and an error will be returned alongside the the remaining results, if any." Thus, we
+			// only return an error if no records were also returned.
+			if len(records) == 0 {
+				return nil, 0, err
+			}
+			su.logger.Warn("SRV records filtered", zap.Error(err))
+		}
+		if !su.refreshAuto || ttl <= 0 {
+			ttl = su.Refresh
+		}
 
-	// otherwise, obtain a write-lock to update the cached value
-	srvsMu.Lock()
-	defer srvsMu.Unlock()
+		upstreams := make([]*Upstream, 0, len(records))
+		for _, rec := range records {
+			su.logger.Debug("discovered SRV record",
+				zap.String("target", rec.Target),
+				zap.Uint16("port", rec.Port),
+				zap.Uint16("priority", rec.Priority),
+				zap.Uint16("weight", rec.Weight))
+
+			if su.ResolveIPs {
+				ips, err := su.lookupIPs(r.Context(), rec.Target)
+				if err != nil {
+					su.logger.Warn("could not resolve SRV target to IPs",
+						zap.String("target", rec.Target), zap.Error(err))
+					continue
+				}
+				port := strconv.Itoa(int(rec.Port))
+				for _, ip := range ips {
+					upstream := &Upstream{Dial: net.JoinHostPort(ip.String(), port)}
+					setSRVWeight(upstream, rec.Priority, rec.Weight)
+					upstreams = append(upstreams, upstream)
+				}
+				continue
+			}
+
+			upstream := &Upstream{
+				Dial: net.JoinHostPort(rec.Target, strconv.Itoa(int(rec.Port))),
+			}
+			setSRVWeight(upstream, rec.Priority, rec.Weight)
+			upstreams = append(upstreams, upstream)
+		}
 
-	// check to see if it's still stale, since we're now in a different
-	// lock from when we first checked freshness; another goroutine might
-	// have refreshed it in the meantime before we re-obtained our lock
-	cached = srvs[suStr]
-	if cached.isFresh() {
-		return cached.upstreams, nil
-	}
+		return upstreams, ttl, nil
+	})
+	return upstreams, err
+}
+
+// srvCache holds the shared, sharded LRU cache of SRV lookups across
+// all SRVUpstreams instances. Evicted or overwritten entries have their
+// SRV weight information cleaned up too, since it would otherwise leak.
+var srvCache = newSRVCache()
+
+func newSRVCache() *lookupCache[[]*Upstream] {
+	lc := newLookupCache[[]*Upstream]("srv", defaultCacheSize)
+	lc.setOnRemove(deleteSRVWeights)
+	return lc
+}
+
+// srvRec is the common shape of an SRV answer, whether it came from the
+// standard library's resolver or a configured Resolver.
+type srvRec struct {
+	Target           string
+	Port             uint16
+	Priority, Weight uint16
+}
 
-	// prepare parameters and perform the SRV lookup
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	service := repl.ReplaceAll(su.Service, "")
-	proto := repl.ReplaceAll(su.Proto, "")
-	name := repl.ReplaceAll(su.Name, "")
-
-	su.logger.Debug("refreshing SRV upstreams",
-		zap.String("service", service),
-		zap.String("proto", proto),
-		zap.String("name", name))
-
-	_, records, err := net.DefaultResolver.LookupSRV(r.Context(), service, proto, name)
-	if err != nil {
-		// From LookupSRV docs: "If the response contains invalid names, those records are filtered
-		// out and an error will be returned alongside the the remaining results, if any." Thus, we
-		// only return an error if no records were also returned.
-		if len(records) == 0 {
-			return nil, err
+// lookupSRV performs the SRV lookup using su.Resolver if configured, or
+// the operating system's resolver otherwise. It also returns the TTL
+// that the caller should cache the result for, which is only
+// meaningful (non-zero) when su.Resolver is configured.
+func (su SRVUpstreams) lookupSRV(ctx context.Context, service, proto, name string) ([]srvRec, time.Duration, error) {
+	if su.Resolver != nil {
+		domain := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+		answers, ttl, err := su.Resolver.LookupSRV(ctx, domain)
+		records := make([]srvRec, len(answers))
+		for i, a := range answers {
+			records[i] = srvRec{Target: a.Target, Port: a.Port, Priority: a.Priority, Weight: a.Weight}
 		}
-		su.logger.Warn("SRV records filtered", zap.Error(err))
+		// answers arrive in wire order; sort by priority, then heaviest weight first
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			return records[i].Weight > records[j].Weight
+		})
+		return records, ttl, err
 	}
 
-	upstreams := make([]*Upstream, len(records))
-	for i, rec := range records {
-		su.logger.Debug("discovered SRV record",
-			zap.String("target", rec.Target),
-			zap.Uint16("port", rec.Port),
-			zap.Uint16("priority", rec.Priority),
-			zap.Uint16("weight", rec.Weight))
-		addr := net.JoinHostPort(rec.Target, strconv.Itoa(int(rec.Port)))
-		upstreams[i] = &Upstream{
-			Dial: net.JoinHostPort(rec.Target, addr),
-		}
+	_, answers, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+	records := make([]srvRec, len(answers))
+	for i, a := range answers {
+		records[i] = srvRec{Target: a.Target, Port: a.Port, Priority: a.Priority, Weight: a.Weight}
 	}
+	return records, 0, err
+}
 
-	// before adding a new one to the cache (as opposed to replacing stale one), make room if cache is full
-	if cached.freshness.IsZero() && len(srvs) >= 100 {
-		for randomKey := range srvs {
-			delete(srvs, randomKey)
-			break
-		}
+// lookupIPs resolves an SRV target to its A/AAAA addresses, using
+// su.Resolver if configured, or the shared OS-resolver-backed cache
+// otherwise.
+func (su SRVUpstreams) lookupIPs(ctx context.Context, target string) ([]net.IP, error) {
+	if su.Resolver != nil {
+		ips, _, err := su.Resolver.LookupIPs(ctx, target)
+		return ips, err
 	}
+	return lookupIPs(ctx, target, su.Refresh)
+}
 
-	srvs[suStr] = srvLookup{
-		srvUpstreams: su,
-		freshness:    time.Now(),
-		upstreams:    upstreams,
+// GetSRVWeights returns the RFC 2782 priority and weight previously
+// recorded for each of the given upstreams, which must have come from
+// this module's GetUpstreams. Upstreams with no recorded information
+// (for example, if they've since been evicted from the cache) are
+// reported with priority 0 and weight 0, which selection policies
+// should treat as "no preference."
+func (SRVUpstreams) GetSRVWeights(upstreams []*Upstream) (priorities, weights []uint16) {
+	priorities = make([]uint16, len(upstreams))
+	weights = make([]uint16, len(upstreams))
+	srvWeightsMu.RLock()
+	defer srvWeightsMu.RUnlock()
+	for i, u := range upstreams {
+		if w, ok := srvWeights[u]; ok {
+			priorities[i] = w.priority
+			weights[i] = w.weight
+		}
 	}
+	return
+}
 
-	return upstreams, nil
+// WeightedUpstreamSource is implemented by upstream sources that can
+// report RFC 2782-style priority and weight alongside the upstreams
+// they return from GetUpstreams, so that selection policies (such as
+// "srv_weighted") can honor them without the UpstreamSource interface
+// itself having to carry that information.
+type WeightedUpstreamSource interface {
+	UpstreamSource
+
+	// GetSRVWeights returns the priority and weight for each of the
+	// given upstreams, in the same order, as previously returned by
+	// GetUpstreams.
+	GetSRVWeights(upstreams []*Upstream) (priorities, weights []uint16)
 }
 
-type srvLookup struct {
-	srvUpstreams SRVUpstreams
-	freshness    time.Time
-	upstreams    []*Upstream
+type srvWeight struct {
+	priority, weight uint16
 }
 
-func (sl srvLookup) isFresh() bool {
-	return time.Since(sl.freshness) < sl.srvUpstreams.Refresh
+func setSRVWeight(u *Upstream, priority, weight uint16) {
+	srvWeightsMu.Lock()
+	srvWeights[u] = srvWeight{priority: priority, weight: weight}
+	srvWeightsMu.Unlock()
+}
+
+func deleteSRVWeights(upstreams []*Upstream) {
+	if len(upstreams) == 0 {
+		return
+	}
+	srvWeightsMu.Lock()
+	for _, u := range upstreams {
+		delete(srvWeights, u)
+	}
+	srvWeightsMu.Unlock()
 }
 
 var (
-	srvs   = make(map[string]srvLookup)
-	srvsMu sync.RWMutex
+	srvWeights   = make(map[*Upstream]srvWeight)
+	srvWeightsMu sync.RWMutex
 )
 
+// resolveIPCache holds the shared, sharded LRU cache of A/AAAA lookups
+// performed on behalf of ResolveIPs (SRVUpstreams' per-target fan-out
+// and AUpstreams' own resolution), keyed by hostname.
+var resolveIPCache = newLookupCache[[]net.IP]("resolve-ip", defaultCacheSize)
+
+// lookupIPs resolves host to its A/AAAA addresses, unless host is
+// already a literal IP (in which case DNS is skipped entirely and the
+// cache isn't consulted). Results are cached for ttl, since the standard
+// library's resolver does not expose the underlying record's TTL for us
+// to honor instead.
+func lookupIPs(ctx context.Context, host string, ttl time.Duration) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ips, _, err := resolveIPCache.GetOrCompute(host, func() ([]net.IP, time.Duration, error) {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			// ttl 0 means this failure isn't actually cached (isFresh
+			// is never true for it), so the next call retries DNS
+			// immediately instead of remembering the failure for ttl.
+			return nil, 0, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		return ips, ttl, nil
+	})
+	return ips, err
+}
+
 // AUpstreams provides upstreams from A/AAAA lookups.
 // Results are cached and refreshed at the configured
 // refresh interval.
@@ -174,6 +336,28 @@ type AUpstreams struct {
 	// The interval at which to refresh the SRV lookup.
 	// Results are cached between lookups. Default: 1m
 	Refresh time.Duration `json:"refresh,omitempty"`
+
+	// If true, and Name is not already a literal IP, resolve it to its
+	// A/AAAA addresses and fan out one Upstream per resolved IP; this
+	// is the default behavior of LookupIPAddr already, but enabling
+	// this also skips DNS entirely when Name is a literal IP, and
+	// shares its resolved-IP cache with SRVUpstreams.
+	ResolveIPs bool `json:"resolve_ips,omitempty"`
+
+	// The DNS resolver to use for A/AAAA lookups. If unset, the
+	// operating system's resolver is used. If Refresh is left unset,
+	// the resolver's reported record TTL is used as the refresh
+	// interval instead of the 1m default.
+	Resolver *Resolver `json:"resolver,omitempty"`
+
+	// The approximate number of distinct name lookups to keep cached at
+	// once, shared across all uses of this module. The cache is split
+	// into 16 shards of CacheSize/16+1 entries each, so a shard can evict
+	// before the total is reached and the total can slightly exceed
+	// CacheSize. Default: 100
+	CacheSize int `json:"cache_size,omitempty"`
+
+	refreshAuto bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -186,91 +370,73 @@ func (AUpstreams) CaddyModule() caddy.ModuleInfo {
 
 func (au AUpstreams) String() string { return au.Name }
 
-func (au *AUpstreams) Provision(_ caddy.Context) error {
+func (au *AUpstreams) Provision(ctx caddy.Context) error {
 	if au.Refresh == 0 {
+		au.refreshAuto = true
 		au.Refresh = time.Minute
 	}
 	if au.Port == "" {
 		au.Port = "80"
 	}
+	if au.Resolver != nil {
+		if err := au.Resolver.Provision(ctx); err != nil {
+			return fmt.Errorf("provisioning resolver: %v", err)
+		}
+	}
+	aCache.resize(au.CacheSize)
 	return nil
 }
 
 func (au AUpstreams) GetUpstreams(r *http.Request) ([]*Upstream, error) {
-	auStr := au.String()
-
-	// first, use a cheap read-lock to return a cached result quickly
-	aAaaaMu.RLock()
-	cached := aAaaa[auStr]
-	aAaaaMu.RUnlock()
-	if cached.isFresh() {
-		return cached.upstreams, nil
-	}
-
-	// otherwise, obtain a write-lock to update the cached value
-	aAaaaMu.Lock()
-	defer aAaaaMu.Unlock()
-
-	// check to see if it's still stale, since we're now in a different
-	// lock from when we first checked freshness; another goroutine might
-	// have refreshed it in the meantime before we re-obtained our lock
-	cached = aAaaa[auStr]
-	if cached.isFresh() {
-		return cached.upstreams, nil
-	}
-
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	name := repl.ReplaceAll(au.Name, "")
-	port := repl.ReplaceAll(au.Port, "")
-
-	ips, err := net.DefaultResolver.LookupIPAddr(r.Context(), name)
-	if err != nil {
-		return nil, err
-	}
-
-	upstreams := make([]*Upstream, len(ips))
-	for i, ip := range ips {
-		upstreams[i] = &Upstream{
-			Dial: net.JoinHostPort(ip.String(), port),
+	upstreams, _, err := aCache.GetOrCompute(au.String(), func() ([]*Upstream, time.Duration, error) {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		name := repl.ReplaceAll(au.Name, "")
+		port := repl.ReplaceAll(au.Port, "")
+
+		var ips []net.IP
+		var ttl time.Duration
+		var err error
+		switch {
+		case au.Resolver != nil:
+			ips, ttl, err = au.Resolver.LookupIPs(r.Context(), name)
+		case au.ResolveIPs:
+			ips, err = lookupIPs(r.Context(), name, au.Refresh)
+		default:
+			var addrs []net.IPAddr
+			addrs, err = net.DefaultResolver.LookupIPAddr(r.Context(), name)
+			ips = make([]net.IP, len(addrs))
+			for i, a := range addrs {
+				ips[i] = a.IP
+			}
 		}
-	}
-
-	// before adding a new one to the cache (as opposed to replacing stale one), make room if cache is full
-	if cached.freshness.IsZero() && len(srvs) >= 100 {
-		for randomKey := range aAaaa {
-			delete(aAaaa, randomKey)
-			break
+		if err != nil {
+			return nil, 0, err
+		}
+		if !au.refreshAuto || ttl <= 0 {
+			ttl = au.Refresh
 		}
-	}
-
-	aAaaa[auStr] = aLookup{
-		aUpstreams: au,
-		freshness:  time.Now(),
-		upstreams:  upstreams,
-	}
-
-	return upstreams, nil
-}
 
-type aLookup struct {
-	aUpstreams AUpstreams
-	freshness  time.Time
-	upstreams  []*Upstream
-}
+		upstreams := make([]*Upstream, len(ips))
+		for i, ip := range ips {
+			upstreams[i] = &Upstream{
+				Dial: net.JoinHostPort(ip.String(), port),
+			}
+		}
 
-func (al aLookup) isFresh() bool {
-	return time.Since(al.freshness) < al.aUpstreams.Refresh
+		return upstreams, ttl, nil
+	})
+	return upstreams, err
 }
 
-var (
-	aAaaa   = make(map[string]aLookup)
-	aAaaaMu sync.RWMutex
-)
+// aCache holds the shared, sharded LRU cache of A/AAAA lookups across
+// all AUpstreams instances.
+var aCache = newLookupCache[[]*Upstream]("a", defaultCacheSize)
 
 // Interface guards
 var (
-	_ caddy.Provisioner = (*SRVUpstreams)(nil)
-	_ UpstreamSource    = (*SRVUpstreams)(nil)
-	_ caddy.Provisioner = (*AUpstreams)(nil)
-	_ UpstreamSource    = (*AUpstreams)(nil)
+	_ caddy.Provisioner      = (*SRVUpstreams)(nil)
+	_ UpstreamSource         = (*SRVUpstreams)(nil)
+	_ WeightedUpstreamSource = (*SRVUpstreams)(nil)
+	_ caddy.Provisioner      = (*AUpstreams)(nil)
+	_ UpstreamSource         = (*AUpstreams)(nil)
 )
@@ -0,0 +1,259 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&ConsulUpstreams{})
+}
+
+// ConsulUpstreams provides upstreams from a Consul service catalog.
+//
+// Unlike SRVUpstreams and AUpstreams, which only refresh on a timed
+// interval, ConsulUpstreams keeps its cached result up to date by
+// holding open a blocking query (using Consul's X-Consul-Index) against
+// the catalog; the instant the set of healthy instances changes, the
+// blocking query returns and the cache is invalidated. Refresh is used
+// only as a fallback interval in case the watch errors or the connection
+// is lost.
+type ConsulUpstreams struct {
+	// Consul agent/server addresses to query, e.g. "127.0.0.1:8500".
+	// Only one is dialed at a time, starting with the first; if a query
+	// against it fails, the next address is dialed and the query is
+	// retried against it before giving up. Default: 127.0.0.1:8500
+	Addresses []string `json:"addresses,omitempty"`
+
+	// The datacenter to query. Default is the agent's own datacenter.
+	Datacenter string `json:"datacenter,omitempty"`
+
+	// The namespace to query (Consul Enterprise only).
+	Namespace string `json:"namespace,omitempty"`
+
+	// The ACL token to use for the query, if required.
+	ACLToken string `json:"acl_token,omitempty"`
+
+	// The name of the service to look up.
+	Service string `json:"service,omitempty"`
+
+	// Only consider instances matching this tag. Optional.
+	Tag string `json:"tag,omitempty"`
+
+	// If true (the default), only instances whose health checks are
+	// all passing are returned.
+	OnlyPassing *bool `json:"only_passing,omitempty"`
+
+	// The interval at which to refresh if the watch fails or is not
+	// making progress. Default: 1m
+	Refresh time.Duration `json:"refresh,omitempty"`
+
+	client *api.Client
+	logger *zap.Logger
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+	lastIndex uint64
+
+	// addrIdx counts the address cu.client currently points at; it is
+	// not reduced, so that address is Addresses[addrIdx%len(Addresses)].
+	// It's only ever touched from Provision (before the
+	// watch goroutine starts) and from that same watch goroutine
+	// afterward, so it needs no lock of its own.
+	addrIdx int
+
+	ctx    caddy.Context
+	cancel context.CancelFunc
+}
+
+// CaddyModule returns the Caddy module information.
+func (*ConsulUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.consul",
+		New: func() caddy.Module { return new(ConsulUpstreams) },
+	}
+}
+
+func (cu *ConsulUpstreams) Provision(ctx caddy.Context) error {
+	cu.ctx = ctx
+	cu.logger = ctx.Logger(cu)
+	if cu.Service == "" {
+		return fmt.Errorf("service name is required")
+	}
+	if cu.Refresh == 0 {
+		cu.Refresh = time.Minute
+	}
+	if cu.OnlyPassing == nil {
+		onlyPassing := true
+		cu.OnlyPassing = &onlyPassing
+	}
+	if len(cu.Addresses) == 0 {
+		cu.Addresses = []string{"127.0.0.1:8500"}
+	}
+
+	if err := cu.dialAddress(cu.addrIdx); err != nil {
+		return err
+	}
+
+	// do a first, synchronous lookup so we have something to serve immediately
+	if _, err := cu.lookup(ctx, 0); err != nil {
+		cu.logger.Warn("initial consul lookup failed; will keep retrying in background", zap.Error(err))
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	cu.cancel = cancel
+	go cu.watch(watchCtx)
+
+	return nil
+}
+
+// dialAddress (re)creates cu.client against cu.Addresses[idx % len(cu.Addresses)].
+func (cu *ConsulUpstreams) dialAddress(idx int) error {
+	addr := cu.Addresses[idx%len(cu.Addresses)]
+
+	cfg := api.DefaultConfig()
+	cfg.Address = addr
+	if cu.Datacenter != "" {
+		cfg.Datacenter = cu.Datacenter
+	}
+	if cu.Namespace != "" {
+		cfg.Namespace = cu.Namespace
+	}
+	if cu.ACLToken != "" {
+		cfg.Token = cu.ACLToken
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("creating consul client for %s: %v", addr, err)
+	}
+	cu.client = client
+	cu.addrIdx = idx
+	return nil
+}
+
+// consulServiceDial returns the dial address for a catalog entry,
+// preferring the service's own address (set when it differs from the
+// node's, e.g. behind a sidecar) and falling back to the node address.
+func consulServiceDial(svc *api.ServiceEntry) string {
+	addr := svc.Service.Address
+	if addr == "" {
+		addr = svc.Node.Address
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(svc.Service.Port))
+}
+
+// lookup performs a (possibly blocking) catalog query and replaces the
+// cached upstream list and index with its result, whether or not the
+// index has advanced. The query is bound to
+// ctx, so canceling ctx (as Cleanup does) aborts an in-flight blocking
+// query instead of leaving it to run for up to WaitTime. If the query
+// against the currently dialed address fails, the next configured
+// address is dialed and the query retried before giving up.
+func (cu *ConsulUpstreams) lookup(ctx context.Context, waitIndex uint64) (uint64, error) {
+	opts := (&api.QueryOptions{
+		Datacenter: cu.Datacenter,
+		Namespace:  cu.Namespace,
+		Token:      cu.ACLToken,
+		WaitIndex:  waitIndex,
+		WaitTime:   5 * time.Minute,
+	}).WithContext(ctx)
+
+	var services []*api.ServiceEntry
+	var meta *api.QueryMeta
+	var err error
+	for attempt := 0; attempt < len(cu.Addresses); attempt++ {
+		services, meta, err = cu.client.Health().Service(cu.Service, cu.Tag, *cu.OnlyPassing, opts)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return waitIndex, ctx.Err()
+		}
+		cu.logger.Warn("consul query failed; trying next configured address",
+			zap.String("address", cu.Addresses[cu.addrIdx%len(cu.Addresses)]),
+			zap.Error(err))
+		if dialErr := cu.dialAddress(cu.addrIdx + 1); dialErr != nil {
+			return waitIndex, dialErr
+		}
+	}
+	if err != nil {
+		return waitIndex, err
+	}
+
+	upstreams := make([]*Upstream, 0, len(services))
+	for _, svc := range services {
+		upstreams = append(upstreams, &Upstream{Dial: consulServiceDial(svc)})
+	}
+
+	cu.mu.Lock()
+	cu.upstreams = upstreams
+	cu.lastIndex = meta.LastIndex
+	cu.mu.Unlock()
+
+	cu.logger.Debug("refreshed consul upstreams",
+		zap.String("service", cu.Service),
+		zap.Int("count", len(upstreams)),
+		zap.Uint64("index", meta.LastIndex))
+
+	return meta.LastIndex, nil
+}
+
+// watch holds open a blocking query against Consul, updating the cache
+// the moment service membership changes, until ctx is canceled. If a
+// query errors, it backs off and retries on the configured Refresh
+// interval instead of hammering the agent.
+func (cu *ConsulUpstreams) watch(ctx context.Context) {
+	waitIndex := cu.lastIndex
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		newIndex, err := cu.lookup(ctx, waitIndex)
+		if err != nil {
+			cu.logger.Error("consul watch failed; falling back to timed refresh", zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cu.Refresh):
+			}
+			continue
+		}
+		waitIndex = newIndex
+	}
+}
+
+func (cu *ConsulUpstreams) Cleanup() error {
+	if cu.cancel != nil {
+		cu.cancel()
+	}
+	return nil
+}
+
+func (cu *ConsulUpstreams) GetUpstreams(_ *http.Request) ([]*Upstream, error) {
+	cu.mu.RLock()
+	defer cu.mu.RUnlock()
+	if cu.upstreams == nil {
+		return nil, fmt.Errorf("no healthy upstreams discovered yet for service %q", cu.Service)
+	}
+	return cu.upstreams, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner  = (*ConsulUpstreams)(nil)
+	_ caddy.CleanerUpper = (*ConsulUpstreams)(nil)
+	_ UpstreamSource     = (*ConsulUpstreams)(nil)
+)
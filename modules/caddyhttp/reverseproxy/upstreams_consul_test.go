@@ -0,0 +1,154 @@
+package reverseproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+func TestConsulServiceDial(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		svc  *api.ServiceEntry
+		want string
+	}{
+		{
+			name: "service address set",
+			svc: &api.ServiceEntry{
+				Node:    &api.Node{Address: "10.0.0.1"},
+				Service: &api.AgentService{Address: "10.0.0.5", Port: 8080},
+			},
+			want: "10.0.0.5:8080",
+		},
+		{
+			name: "service address empty, falls back to node",
+			svc: &api.ServiceEntry{
+				Node:    &api.Node{Address: "10.0.0.1"},
+				Service: &api.AgentService{Port: 8080},
+			},
+			want: "10.0.0.1:8080",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := consulServiceDial(tc.svc); got != tc.want {
+				t.Errorf("consulServiceDial() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConsulUpstreamsGetUpstreamsBeforeDiscovery(t *testing.T) {
+	cu := &ConsulUpstreams{Service: "api"}
+	if _, err := cu.GetUpstreams(nil); err == nil {
+		t.Error("expected an error before any upstreams have been discovered")
+	}
+}
+
+func TestConsulUpstreamsGetUpstreams(t *testing.T) {
+	cu := &ConsulUpstreams{Service: "api"}
+	want := []*Upstream{{Dial: "10.0.0.5:8080"}}
+	cu.mu.Lock()
+	cu.upstreams = want
+	cu.mu.Unlock()
+
+	got, err := cu.GetUpstreams(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Dial != "10.0.0.5:8080" {
+		t.Errorf("unexpected upstreams: %v", got)
+	}
+}
+
+func TestConsulUpstreamsDialAddressCycles(t *testing.T) {
+	cu := &ConsulUpstreams{Addresses: []string{"127.0.0.1:8500", "127.0.0.1:8501"}}
+	if err := cu.dialAddress(0); err != nil {
+		t.Fatalf("dialAddress(0): %v", err)
+	}
+	if cu.addrIdx != 0 {
+		t.Errorf("addrIdx = %d, want 0", cu.addrIdx)
+	}
+	if err := cu.dialAddress(1); err != nil {
+		t.Fatalf("dialAddress(1): %v", err)
+	}
+	if cu.addrIdx != 1 {
+		t.Errorf("addrIdx = %d, want 1", cu.addrIdx)
+	}
+	// wraps back around to the first address
+	if err := cu.dialAddress(2); err != nil {
+		t.Fatalf("dialAddress(2): %v", err)
+	}
+	if cu.addrIdx != 2 {
+		t.Errorf("addrIdx = %d, want 2", cu.addrIdx)
+	}
+}
+
+// deadTCPAddr returns the address of a TCP listener that's immediately
+// closed, so dialing it fails fast with "connection refused" instead of
+// timing out the way an unroutable address would.
+func deadTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to allocate a dead address: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestConsulUpstreamsLookupFailsOverToWorkingAddress(t *testing.T) {
+	want := []*Upstream{{Dial: "10.0.0.5:8080"}}
+
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{
+			{
+				Node:    &api.Node{Address: "10.0.0.5"},
+				Service: &api.AgentService{Address: "10.0.0.5", Port: 8080},
+			},
+		})
+	}))
+	defer fake.Close()
+
+	cu := &ConsulUpstreams{
+		Service:   "api",
+		Addresses: []string{deadTCPAddr(t), fake.Listener.Addr().String()},
+		logger:    zap.NewNop(),
+	}
+	onlyPassing := true
+	cu.OnlyPassing = &onlyPassing
+	if err := cu.dialAddress(0); err != nil {
+		t.Fatalf("dialAddress(0): %v", err)
+	}
+
+	newIndex, err := cu.lookup(caddy.Context{Context: context.Background()}, 0)
+	if err != nil {
+		t.Fatalf("lookup() did not fail over to the working address: %v", err)
+	}
+	if newIndex != 42 {
+		t.Errorf("newIndex = %d, want 42", newIndex)
+	}
+	if cu.addrIdx != 1 {
+		t.Errorf("addrIdx = %d, want 1 (should have moved past the dead address)", cu.addrIdx)
+	}
+
+	got, err := cu.GetUpstreams(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != len(want) || got[0].Dial != want[0].Dial {
+		t.Errorf("upstreams = %v, want %v", got, want)
+	}
+}
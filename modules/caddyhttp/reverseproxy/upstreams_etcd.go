@@ -0,0 +1,184 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&EtcdUpstreams{})
+}
+
+// EtcdUpstreams provides upstreams from a key prefix in etcd, where each
+// key under the prefix holds the dial address of one instance (for
+// example, a key like "/services/api/10.0.0.5:8080" with the dial
+// address as the key's last path segment, or as its value).
+//
+// Instead of polling, it holds open an etcd watch on the prefix so the
+// cache is invalidated the instant a key is created or deleted. If the
+// watch channel closes (e.g. due to a connection error), it falls back
+// to a timed refresh until the watch can be re-established.
+type EtcdUpstreams struct {
+	// The etcd endpoints to connect to.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// Username/password for etcd authentication, if enabled.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// The key prefix under which each key represents one upstream
+	// instance.
+	Prefix string `json:"prefix,omitempty"`
+
+	// The interval at which to refresh if the watch is interrupted.
+	// Default: 1m
+	Refresh time.Duration `json:"refresh,omitempty"`
+
+	client *clientv3.Client
+	logger *zap.Logger
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+
+	cancel context.CancelFunc
+}
+
+// CaddyModule returns the Caddy module information.
+func (*EtcdUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.etcd",
+		New: func() caddy.Module { return new(EtcdUpstreams) },
+	}
+}
+
+func (eu *EtcdUpstreams) Provision(ctx caddy.Context) error {
+	eu.logger = ctx.Logger(eu)
+	if eu.Prefix == "" {
+		return fmt.Errorf("prefix is required")
+	}
+	if eu.Refresh == 0 {
+		eu.Refresh = time.Minute
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   eu.Endpoints,
+		Username:    eu.Username,
+		Password:    eu.Password,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("creating etcd client: %v", err)
+	}
+	eu.client = client
+
+	if err := eu.refresh(ctx); err != nil {
+		eu.logger.Warn("initial etcd lookup failed; will keep retrying in background", zap.Error(err))
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	eu.cancel = cancel
+	go eu.watch(watchCtx)
+
+	return nil
+}
+
+// etcdKVAddress returns the dial address for a key/value pair under the
+// configured prefix: the value if it's non-empty, otherwise the last
+// path segment of the key itself.
+func etcdKVAddress(key, value string) string {
+	if value != "" {
+		return value
+	}
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+func (eu *EtcdUpstreams) refresh(ctx context.Context) error {
+	resp, err := eu.client.Get(ctx, eu.Prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	upstreams := make([]*Upstream, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		upstreams = append(upstreams, &Upstream{Dial: etcdKVAddress(string(kv.Key), string(kv.Value))})
+	}
+
+	eu.mu.Lock()
+	eu.upstreams = upstreams
+	eu.mu.Unlock()
+
+	eu.logger.Debug("refreshed etcd upstreams",
+		zap.String("prefix", eu.Prefix),
+		zap.Int("count", len(upstreams)))
+
+	return nil
+}
+
+// watch holds open a watch on the configured prefix, refreshing the
+// cache on every event, until ctx is canceled. If the watch channel
+// closes unexpectedly, it falls back to polling on the Refresh interval
+// until the watch can be re-established.
+func (eu *EtcdUpstreams) watch(ctx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		watchChan := eu.client.Watch(ctx, eu.Prefix, clientv3.WithPrefix())
+		for resp := range watchChan {
+			if resp.Err() != nil {
+				eu.logger.Error("etcd watch error", zap.Error(resp.Err()))
+				break
+			}
+			if err := eu.refresh(ctx); err != nil {
+				eu.logger.Error("refreshing etcd upstreams after watch event", zap.Error(err))
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		eu.logger.Warn("etcd watch channel closed; falling back to timed refresh before retrying watch")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eu.Refresh):
+		}
+		_ = eu.refresh(ctx)
+	}
+}
+
+func (eu *EtcdUpstreams) Cleanup() error {
+	if eu.cancel != nil {
+		eu.cancel()
+	}
+	if eu.client != nil {
+		return eu.client.Close()
+	}
+	return nil
+}
+
+func (eu *EtcdUpstreams) GetUpstreams(_ *http.Request) ([]*Upstream, error) {
+	eu.mu.RLock()
+	defer eu.mu.RUnlock()
+	if eu.upstreams == nil {
+		return nil, fmt.Errorf("no upstreams discovered yet for prefix %q", eu.Prefix)
+	}
+	return eu.upstreams, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner  = (*EtcdUpstreams)(nil)
+	_ caddy.CleanerUpper = (*EtcdUpstreams)(nil)
+	_ UpstreamSource     = (*EtcdUpstreams)(nil)
+)
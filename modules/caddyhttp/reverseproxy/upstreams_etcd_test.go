@@ -0,0 +1,42 @@
+package reverseproxy
+
+import "testing"
+
+func TestEtcdKVAddress(t *testing.T) {
+	for _, tc := range []struct {
+		name, key, value, want string
+	}{
+		{"value set", "/services/api/10.0.0.5:8080", "10.0.0.6:8080", "10.0.0.6:8080"},
+		{"value empty, falls back to key", "/services/api/10.0.0.5:8080", "", "10.0.0.5:8080"},
+		{"key with no slash", "justakey", "", "justakey"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := etcdKVAddress(tc.key, tc.value); got != tc.want {
+				t.Errorf("etcdKVAddress(%q, %q) = %q, want %q", tc.key, tc.value, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEtcdUpstreamsGetUpstreamsBeforeDiscovery(t *testing.T) {
+	eu := &EtcdUpstreams{Prefix: "/services/api/"}
+	if _, err := eu.GetUpstreams(nil); err == nil {
+		t.Error("expected an error before any upstreams have been discovered")
+	}
+}
+
+func TestEtcdUpstreamsGetUpstreams(t *testing.T) {
+	eu := &EtcdUpstreams{Prefix: "/services/api/"}
+	want := []*Upstream{{Dial: "10.0.0.5:8080"}}
+	eu.mu.Lock()
+	eu.upstreams = want
+	eu.mu.Unlock()
+
+	got, err := eu.GetUpstreams(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Dial != "10.0.0.5:8080" {
+		t.Errorf("unexpected upstreams: %v", got)
+	}
+}
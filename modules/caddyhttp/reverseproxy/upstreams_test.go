@@ -0,0 +1,116 @@
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestLookupIPsSkipsDNSAndCacheForLiteralIP(t *testing.T) {
+	ips, err := lookupIPs(context.Background(), "10.0.0.7", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.7")) {
+		t.Errorf("ips = %v, want [10.0.0.7]", ips)
+	}
+}
+
+func TestLookupIPsServesFromSharedCache(t *testing.T) {
+	want := []net.IP{net.ParseIP("10.0.0.8"), net.ParseIP("10.0.0.9")}
+	resolveIPCache.GetOrCompute("cached.example.com", func() ([]net.IP, time.Duration, error) {
+		return want, time.Minute, nil
+	})
+
+	// if lookupIPs actually performed a DNS query instead of serving the
+	// fresh cache entry populated above, this would hang or fail in a
+	// sandboxed test environment with no working resolver.
+	ips, err := lookupIPs(context.Background(), "cached.example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != len(want) {
+		t.Fatalf("ips = %v, want %v", ips, want)
+	}
+	for i := range want {
+		if !ips[i].Equal(want[i]) {
+			t.Errorf("ips[%d] = %v, want %v", i, ips[i], want[i])
+		}
+	}
+}
+
+// newTestUpstreamsRequest builds a request carrying the replacer that
+// GetUpstreams expects to find in its context.
+func newTestUpstreamsRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, &caddy.Replacer{})
+	return req.WithContext(ctx)
+}
+
+func TestSRVUpstreamsResolveIPsFansOutOneUpstreamPerIP(t *testing.T) {
+	su := SRVUpstreams{
+		Service: "http", Proto: "tcp", Name: "fanout.example.com",
+		ResolveIPs: true,
+		Resolver: &Resolver{
+			srvCache: newLookupCache[[]*dns.SRV]("test-srv-fanout", defaultCacheSize),
+			ipCache:  newLookupCache[[]net.IP]("test-a-fanout", defaultCacheSize),
+		},
+		logger: zap.NewNop(),
+	}
+	su.Resolver.srvCache.GetOrCompute(su.String(), func() ([]*dns.SRV, time.Duration, error) {
+		return []*dns.SRV{{
+			Target: "headless.fanout.example.com.", Port: 8080, Priority: 1, Weight: 1,
+		}}, time.Minute, nil
+	})
+	su.Resolver.ipCache.GetOrCompute("headless.fanout.example.com.", func() ([]net.IP, time.Duration, error) {
+		return []net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")}, time.Minute, nil
+	})
+
+	upstreams, err := su.GetUpstreams(newTestUpstreamsRequest())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]bool{"10.0.1.1:8080": true, "10.0.1.2:8080": true}
+	if len(upstreams) != len(want) {
+		t.Fatalf("got %d upstreams, want %d: %v", len(upstreams), len(want), upstreams)
+	}
+	for _, u := range upstreams {
+		if !want[u.Dial] {
+			t.Errorf("unexpected upstream dial address %q", u.Dial)
+		}
+	}
+}
+
+func TestSRVUpstreamsResolveIPsSkipsLookupForLiteralTarget(t *testing.T) {
+	su := SRVUpstreams{
+		Service: "http", Proto: "tcp", Name: "literal.example.com",
+		ResolveIPs: true,
+		Resolver: &Resolver{
+			srvCache: newLookupCache[[]*dns.SRV]("test-srv-literal", defaultCacheSize),
+			ipCache:  newLookupCache[[]net.IP]("test-a-literal", defaultCacheSize),
+		},
+		logger: zap.NewNop(),
+	}
+	su.Resolver.srvCache.GetOrCompute(su.String(), func() ([]*dns.SRV, time.Duration, error) {
+		return []*dns.SRV{{Target: "10.0.2.9", Port: 9090, Priority: 1, Weight: 1}}, time.Minute, nil
+	})
+
+	// the ipCache is deliberately left empty: if lookupIPs failed to
+	// recognize the literal IP target and tried to consult or populate
+	// it, this would either panic on the nil Resolver.client or return
+	// an error.
+	upstreams, err := su.GetUpstreams(newTestUpstreamsRequest())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(upstreams) != 1 || upstreams[0].Dial != "10.0.2.9:9090" {
+		t.Errorf("upstreams = %v, want [10.0.2.9:9090]", upstreams)
+	}
+}